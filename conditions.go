@@ -0,0 +1,48 @@
+package okproxy
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// RequestCond reports whether a request-phase interceptor registered via
+// OnRequest should run for r.
+type RequestCond func(r *http.Request) bool
+
+// ResponseCond reports whether a response-phase interceptor registered via
+// OnResponse should run for resp.
+type ResponseCond func(resp *http.Response) bool
+
+// HostIs matches requests whose Host equals host.
+func HostIs(host string) RequestCond {
+	return func(r *http.Request) bool {
+		return r.Host == host
+	}
+}
+
+// PathMatches matches requests whose URL path matches re.
+func PathMatches(re *regexp.Regexp) RequestCond {
+	return func(r *http.Request) bool {
+		return re.MatchString(r.URL.Path)
+	}
+}
+
+// ContentTypeIs matches requests whose Content-Type header equals
+// contentType, ignoring any parameters such as charset.
+func ContentTypeIs(contentType string) RequestCond {
+	return func(r *http.Request) bool {
+		ct := r.Header.Get("Content-Type")
+		if idx := strings.Index(ct, ";"); idx != -1 {
+			ct = ct[:idx]
+		}
+		return strings.TrimSpace(ct) == contentType
+	}
+}
+
+// MethodIs matches requests using the given HTTP method.
+func MethodIs(method string) RequestCond {
+	return func(r *http.Request) bool {
+		return r.Method == method
+	}
+}
@@ -0,0 +1,68 @@
+package okproxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// hopByHopHeaders are stripped from every forwarded request and response,
+// mirroring the set the Go stdlib reverse proxy removes: RFC 7230 section
+// 6.1 headers that describe a single connection and must not be forwarded.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopByHopHeaders strips the standard hop-by-hop headers from h, plus
+// any additional headers the sender named in its Connection header. A bare
+// "Te: trailers" is preserved, since it is the one hop-by-hop value an
+// intermediary is expected to forward end-to-end.
+func removeHopByHopHeaders(h http.Header) {
+	preserveTrailers := strings.EqualFold(strings.TrimSpace(h.Get("Te")), "trailers")
+
+	if connection := h.Get("Connection"); connection != "" {
+		for _, name := range strings.Split(connection, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+
+	for _, name := range hopByHopHeaders {
+		h.Del(name)
+	}
+
+	if preserveTrailers {
+		h.Set("Te", "trailers")
+	}
+}
+
+// setForwardedHeaders prepares X-Forwarded-For and sets X-Forwarded-Proto on
+// r based on r.TLS. httputil.ReverseProxy itself appends the client's
+// address to whatever X-Forwarded-For is left on the request once Director
+// returns, so this only decides what that starting value is: when
+// trustForwardHeaders is true, any X-Forwarded-For the client sent is kept
+// and the proxy's own append chains onto it; when false, it is deleted so
+// the chain starts fresh with just the client's address, discarding
+// whatever the client sent. X-Forwarded-Proto has no such built-in handling,
+// so it's fully owned here: overwritten unless trustForwardHeaders is true
+// and the client already set one.
+func setForwardedHeaders(r *http.Request, trustForwardHeaders bool) {
+	if !trustForwardHeaders {
+		r.Header.Del("X-Forwarded-For")
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if prior := r.Header.Get("X-Forwarded-Proto"); prior == "" || !trustForwardHeaders {
+		r.Header.Set("X-Forwarded-Proto", scheme)
+	}
+}
@@ -0,0 +1,191 @@
+package okproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRemoveHopByHopHeaders(t *testing.T) {
+	tests := []struct {
+		name            string
+		headers         map[string]string
+		expectedPresent map[string]string
+		expectedAbsent  []string
+	}{
+		{
+			"Strips standard hop-by-hop headers",
+			map[string]string{
+				"Keep-Alive":          "timeout=5",
+				"Proxy-Authenticate":  "Basic",
+				"Proxy-Authorization": "Basic abc",
+				"Trailer":             "X-Checksum",
+				"Transfer-Encoding":   "chunked",
+				"Upgrade":             "websocket",
+				"Content-Type":        "application/json",
+			},
+			map[string]string{"Content-Type": "application/json"},
+			[]string{"Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "Trailer", "Transfer-Encoding", "Upgrade"},
+		},
+		{
+			"Strips headers named in Connection",
+			map[string]string{
+				"Connection":   "X-Custom-Hop",
+				"X-Custom-Hop": "drop-me",
+				"Content-Type": "text/plain",
+			},
+			map[string]string{"Content-Type": "text/plain"},
+			[]string{"Connection", "X-Custom-Hop"},
+		},
+		{
+			"Preserves Te: trailers",
+			map[string]string{"Te": "trailers"},
+			map[string]string{"Te": "trailers"},
+			nil,
+		},
+		{
+			"Strips Te with other values",
+			map[string]string{"Te": "gzip"},
+			nil,
+			[]string{"Te"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := make(http.Header)
+			for k, v := range tt.headers {
+				h.Set(k, v)
+			}
+
+			removeHopByHopHeaders(h)
+
+			for k, v := range tt.expectedPresent {
+				if got := h.Get(k); got != v {
+					t.Errorf("Expected header %q to be %q got %q", k, v, got)
+				}
+			}
+			for _, k := range tt.expectedAbsent {
+				if got := h.Get(k); got != "" {
+					t.Errorf("Expected header %q to be stripped, got %q", k, got)
+				}
+			}
+		})
+	}
+}
+
+func TestSetForwardedHeaders(t *testing.T) {
+	tests := []struct {
+		name                string
+		priorForwardedFor   string
+		priorForwardedProto string
+		trustForwardHeaders bool
+		expectedFor         string
+		expectedProto       string
+	}{
+		{
+			"No prior headers, untrusted",
+			"",
+			"",
+			false,
+			"",
+			"http",
+		},
+		{
+			"Prior X-Forwarded-For deleted when untrusted",
+			"198.51.100.1",
+			"https",
+			false,
+			"",
+			"http",
+		},
+		{
+			"Prior X-Forwarded-For kept when trusted, for ReverseProxy to append to",
+			"198.51.100.1",
+			"",
+			true,
+			"198.51.100.1",
+			"http",
+		},
+		{
+			"Prior X-Forwarded-Proto kept when trusted",
+			"",
+			"https",
+			true,
+			"",
+			"https",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.priorForwardedFor != "" {
+				r.Header.Set("X-Forwarded-For", tt.priorForwardedFor)
+			}
+			if tt.priorForwardedProto != "" {
+				r.Header.Set("X-Forwarded-Proto", tt.priorForwardedProto)
+			}
+
+			setForwardedHeaders(r, tt.trustForwardHeaders)
+
+			if got := r.Header.Get("X-Forwarded-For"); got != tt.expectedFor {
+				t.Errorf("Expected X-Forwarded-For %q got %q", tt.expectedFor, got)
+			}
+			if got := r.Header.Get("X-Forwarded-Proto"); got != tt.expectedProto {
+				t.Errorf("Expected X-Forwarded-Proto %q got %q", tt.expectedProto, got)
+			}
+		})
+	}
+}
+
+func TestServeReverseProxyStripsHopByHopAndSetsForwardedHeaders(t *testing.T) {
+	var received http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+	}))
+	defer backend.Close()
+
+	p := New(backend.URL)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "203.0.113.5:54321"
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+
+	p.proxy.serveReverseProxy(w, r, &mockErrorHandler{})
+
+	if received.Get("Connection") != "" || received.Get("Upgrade") != "" {
+		t.Errorf("Expected hop-by-hop headers to be stripped, got Connection=%q Upgrade=%q", received.Get("Connection"), received.Get("Upgrade"))
+	}
+	if got := received.Get("X-Forwarded-For"); got != "203.0.113.5" {
+		t.Errorf("Expected spoofed X-Forwarded-For to be discarded, got %q", got)
+	}
+	if got := received.Get("X-Forwarded-Proto"); got != "http" {
+		t.Errorf("Expected X-Forwarded-Proto %q got %q", "http", got)
+	}
+}
+
+func TestServeReverseProxyTrustsForwardHeaders(t *testing.T) {
+	var received http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+	}))
+	defer backend.Close()
+
+	p := New(backend.URL)
+	p.SetTrustForwardHeaders(true)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "203.0.113.5:54321"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+
+	p.proxy.serveReverseProxy(w, r, &mockErrorHandler{})
+
+	if got := received.Get("X-Forwarded-For"); got != "198.51.100.1, 203.0.113.5" {
+		t.Errorf("Expected X-Forwarded-For chain %q got %q", "198.51.100.1, 203.0.113.5", got)
+	}
+}
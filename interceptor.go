@@ -0,0 +1,61 @@
+package okproxy
+
+import "net/http"
+
+// requestInterceptor pairs a RequestCond with the handler to run when it
+// matches, as registered through OnRequest.
+type requestInterceptor struct {
+	cond RequestCond
+	fn   func(*http.Request) (*http.Request, *http.Response)
+}
+
+// responseInterceptor pairs a ResponseCond with the handler to run when it
+// matches, as registered through OnResponse.
+type responseInterceptor struct {
+	cond ResponseCond
+	fn   func(*http.Response) *http.Response
+}
+
+// runRequestInterceptors runs matching request-phase interceptors in
+// registration order, mutating req in place. It returns the response from
+// the first interceptor that short-circuits the call, stopping before any
+// later interceptor runs.
+func (rp *reverseProxy) runRequestInterceptors(req *http.Request) *http.Response {
+	for _, ri := range rp.requestInterceptors {
+		if !ri.cond(req) {
+			continue
+		}
+
+		modified, resp := ri.fn(req)
+		if modified != nil {
+			*req = *modified
+		}
+		if resp != nil {
+			return resp
+		}
+	}
+
+	return nil
+}
+
+// runResponseInterceptors runs matching response-phase interceptors in
+// registration order, mutating resp in place.
+func (rp *reverseProxy) runResponseInterceptors(resp *http.Response) {
+	for _, ri := range rp.responseInterceptors {
+		if !ri.cond(resp) {
+			continue
+		}
+
+		if modified := ri.fn(resp); modified != nil {
+			*resp = *modified
+		}
+	}
+}
+
+// roundTripperFunc adapts a function to http.RoundTripper, the same way
+// http.HandlerFunc adapts a function to http.Handler.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
@@ -0,0 +1,88 @@
+package okproxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+func TestOnRequestHeaderInjection(t *testing.T) {
+	var receivedHeader string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedHeader = r.Header.Get("X-Injected")
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	p := New(backend.URL)
+	p.OnRequest(MethodIs("GET"), func(r *http.Request) (*http.Request, *http.Response) {
+		r.Header.Set("X-Injected", "yes")
+		return r, nil
+	})
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	p.proxy.serveReverseProxy(w, r, &mockErrorHandler{})
+
+	if receivedHeader != "yes" {
+		t.Errorf("Expected backend to receive injected header, got %q", receivedHeader)
+	}
+}
+
+func TestOnRequestShortCircuit(t *testing.T) {
+	backendCalled := false
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendCalled = true
+		w.Write([]byte("upstream"))
+	}))
+	defer backend.Close()
+
+	p := New(backend.URL)
+	p.OnRequest(PathMatches(regexp.MustCompile(`^/blocked$`)), func(r *http.Request) (*http.Request, *http.Response) {
+		resp := &http.Response{
+			StatusCode: http.StatusForbidden,
+			Body:       http.NoBody,
+			Header:     make(http.Header),
+		}
+		return nil, resp
+	})
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/blocked", nil)
+	p.proxy.serveReverseProxy(w, r, &mockErrorHandler{})
+
+	if backendCalled {
+		t.Error("Expected upstream backend not to be called on short-circuit")
+	}
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d got %d", http.StatusForbidden, w.Code)
+	}
+}
+
+func TestOnResponseBodyRewrite(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hi"))
+	}))
+	defer backend.Close()
+
+	p := New(backend.URL)
+	p.OnResponse(func(resp *http.Response) bool { return resp.StatusCode == http.StatusOK }, func(resp *http.Response) *http.Response {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		duplicated := append(body, body...)
+		resp.Body = io.NopCloser(bytes.NewReader(duplicated))
+		resp.ContentLength = int64(len(duplicated))
+		return resp
+	})
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	p.proxy.serveReverseProxy(w, r, &mockErrorHandler{})
+
+	if got := w.Body.String(); got != "hihi" {
+		t.Errorf("Expected duplicated body %q got %q", "hihi", got)
+	}
+}
@@ -1,32 +1,76 @@
-// Package OKProxy provides a simple proxy using httputil.NewSingleHostReverseProxy.
-package main
+// Package okproxy provides a simple proxy using httputil.NewSingleHostReverseProxy.
+package okproxy
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"strings"
+	"time"
 )
 
+// defaultMaxPayloadBytes bounds how much of a PayloadRequestProxyHandler
+// request body is read when decoding the proxyURL field, absent an
+// OKProxy.MaxPayloadBytes override.
+const defaultMaxPayloadBytes = 1 << 20 // 1 MiB
+
 // OKProxy is the main struct and embeds a ProxyReverser.
 type OKProxy struct {
 	proxy ProxyReverser
+
+	// MITM enables TLS-terminating interception of CONNECT tunnels opened
+	// through TunnelProxyHandler. When false, CONNECT requests are blindly
+	// tunneled instead. CACert and CAKey must be set when MITM is true.
+	MITM bool
+
+	// CACert and CAKey are used to mint a leaf certificate for the
+	// requested SNI on the fly when MITM is enabled.
+	CACert *x509.Certificate
+	CAKey  crypto.Signer
+
+	// upstream, when set via NewWithConfig, enables dynamic upstream
+	// selection through RouteProxyHandler instead of forwarding to the
+	// single fixed URL held by proxy.
+	upstream         *UpstreamConfig
+	stopHealthChecks chan struct{}
+
+	// MaxPayloadBytes caps the body PayloadRequestProxyHandler will read
+	// while decoding the proxyURL field. Zero uses defaultMaxPayloadBytes.
+	MaxPayloadBytes int64
 }
 
 // reverseProxy stores the proxy URL and access methods.
 type reverseProxy struct {
-	URL string `json:"proxyURL"`
+	URL                 string `json:"proxyURL"`
+	UpgradeAware        bool   `json:"-"`
+	PreserveHost        bool   `json:"-"`
+	TrustForwardHeaders bool   `json:"-"`
+
+	requestInterceptors  []requestInterceptor
+	responseInterceptors []responseInterceptor
 }
 
 type ProxyReverser interface {
 	SetProxyURL(string)
 	GetProxyURL() string
+	SetUpgradeAware(bool)
+	GetUpgradeAware() bool
+	SetPreserveHost(bool)
+	GetPreserveHost() bool
+	SetTrustForwardHeaders(bool)
+	GetTrustForwardHeaders() bool
+	OnRequest(cond RequestCond, fn func(*http.Request) (*http.Request, *http.Response))
+	OnResponse(cond ResponseCond, fn func(*http.Response) *http.Response)
 	serveReverseProxy(http.ResponseWriter, *http.Request, ErrorHandler)
-	decodeURLFromBody(r *http.Request, errorHandler ErrorHandler) error
+	decodeURLFromBody(w http.ResponseWriter, r *http.Request, maxPayloadBytes int64, errorHandler ErrorHandler) error
 }
 
 // ErrorHandler interface that can be passed into proxy handlers.
@@ -36,7 +80,123 @@ type ErrorHandler interface {
 
 // New allocates a new OKProxy and reverseProxy with empty URL string.
 func New(URL string) *OKProxy {
-	return &OKProxy{&reverseProxy{URL}}
+	return &OKProxy{proxy: &reverseProxy{URL: URL}}
+}
+
+// NewWithConfig allocates an OKProxy that routes each request dynamically
+// according to config, rather than forwarding to a single fixed URL. Serve
+// requests through it with RouteProxyHandler. Routes with a static backend
+// pool (To and/or Backends, no FromRegex) are health-checked in the
+// background when HealthCheckPath is set; call Close to stop those checks.
+func NewWithConfig(config *UpstreamConfig) *OKProxy {
+	p := &OKProxy{
+		proxy:            &reverseProxy{},
+		upstream:         config,
+		stopHealthChecks: make(chan struct{}),
+	}
+
+	for _, route := range config.Routes {
+		if route.FromRegex != nil {
+			continue
+		}
+
+		backends := append([]string{}, route.Backends...)
+		if route.To != "" {
+			backends = append([]string{route.To}, backends...)
+		}
+		route.pool = newBackendPool(backends)
+
+		if route.HealthCheckPath != "" {
+			interval := route.HealthCheckInterval
+			if interval == 0 {
+				interval = 10 * time.Second
+			}
+			route.pool.startHealthChecks(route.HealthCheckPath, interval, p.stopHealthChecks)
+		}
+	}
+
+	return p
+}
+
+// Close stops any background health-check polling started by NewWithConfig.
+func (p *OKProxy) Close() {
+	if p.stopHealthChecks != nil {
+		close(p.stopHealthChecks)
+	}
+}
+
+// RouteProxyHandler serves requests through the routes configured via
+// NewWithConfig, picking the matching route and a healthy backend from its
+// pool for each request. errorHandler is invoked when no UpstreamConfig is
+// set, no route matches, or no healthy backend is available.
+func (p *OKProxy) RouteProxyHandler(errorHandler ErrorHandler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p.upstream == nil {
+			errorHandler.ServerErrorHandler(w, r, errors.New("RouteProxyHandler: no UpstreamConfig configured"))
+			return
+		}
+
+		route := p.upstream.matchRoute(r)
+		if route == nil {
+			errorHandler.ServerErrorHandler(w, r, errors.New("RouteProxyHandler: no route matched "+r.Host))
+			return
+		}
+
+		target, err := route.resolveTarget(r)
+		if err != nil {
+			errorHandler.ServerErrorHandler(w, r, err)
+			return
+		}
+
+		if route.pool != nil {
+			route.pool.begin(target)
+			defer route.pool.end(target)
+		}
+
+		rp, ok := p.proxy.(*reverseProxy)
+		if !ok {
+			errorHandler.ServerErrorHandler(w, r, errors.New("RouteProxyHandler: proxy does not support dynamic routing"))
+			return
+		}
+
+		perRequest := rp.clone()
+		perRequest.SetProxyURL(target)
+		perRequest.SetPreserveHost(route.PreserveHost)
+		perRequest.serveReverseProxy(w, r, errorHandler)
+	})
+}
+
+// SetUpgradeAware toggles upgrade-aware proxying. When enabled, requests
+// carrying an Upgrade header together with a Connection header that lists
+// "Upgrade" (e.g. WebSocket) bypass httputil.ReverseProxy
+// and are instead hijacked and spliced directly to the backend connection,
+// which httputil.ReverseProxy cannot do on its own.
+func (p *OKProxy) SetUpgradeAware(upgradeAware bool) {
+	p.proxy.SetUpgradeAware(upgradeAware)
+}
+
+// OnRequest registers a request-phase interceptor that runs whenever cond
+// matches an incoming request. fn may return a modified request, a
+// *http.Response to short-circuit the upstream call, or both nil to leave
+// the request untouched. Interceptors run in registration order.
+func (p *OKProxy) OnRequest(cond RequestCond, fn func(*http.Request) (*http.Request, *http.Response)) {
+	p.proxy.OnRequest(cond, fn)
+}
+
+// OnResponse registers a response-phase interceptor that runs whenever cond
+// matches the upstream response. fn may return a modified response, or nil
+// to leave the response untouched. Interceptors run in registration order.
+func (p *OKProxy) OnResponse(cond ResponseCond, fn func(*http.Response) *http.Response) {
+	p.proxy.OnResponse(cond, fn)
+}
+
+// SetTrustForwardHeaders controls how incoming X-Forwarded-* headers are
+// handled. When true, the client's address is appended to an existing
+// X-Forwarded-For chain and X-Forwarded-Proto is left alone if already set.
+// When false (the default), both headers are overwritten with the values
+// serveReverseProxy computes, ignoring whatever the client sent.
+func (p *OKProxy) SetTrustForwardHeaders(trustForwardHeaders bool) {
+	p.proxy.SetTrustForwardHeaders(trustForwardHeaders)
 }
 
 // PathRequestProxyHandler allows the creation of a proxy for the specified path.
@@ -57,12 +217,17 @@ func (p *OKProxy) PathRequestProxyHandler(path string, errorHandler ErrorHandler
 }
 
 // PaylodRequesProxyHandler allows the creation of a proxy from the value of the
-// proxyURL field in a JSON body.
+// proxyURL field in a JSON body, or from an X-Proxy-URL header.
+// When the request carries an X-Proxy-URL header, its value is used directly
+// and the body is left untouched. Otherwise the body must be
+// application/json and is decoded for its proxyURL field, reading at most
+// MaxPayloadBytes of it.
 // errorHandler interface must be passed for error handling.
 func (p *OKProxy) PayloadRequestProxyHandler(errorHandler ErrorHandler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		err := p.proxy.decodeURLFromBody(r, errorHandler)
-		if err != nil {
+		if headerURL := r.Header.Get("X-Proxy-URL"); headerURL != "" {
+			p.proxy.SetProxyURL(headerURL)
+		} else if err := p.proxy.decodeURLFromBody(w, r, p.MaxPayloadBytes, errorHandler); err != nil {
 			errorHandler.ServerErrorHandler(w, r, err)
 			return
 		}
@@ -82,6 +247,47 @@ func (rp *reverseProxy) GetProxyURL() string {
 	return rp.URL
 }
 
+func (rp *reverseProxy) SetUpgradeAware(upgradeAware bool) {
+	rp.UpgradeAware = upgradeAware
+}
+
+func (rp *reverseProxy) GetUpgradeAware() bool {
+	return rp.UpgradeAware
+}
+
+func (rp *reverseProxy) SetPreserveHost(preserveHost bool) {
+	rp.PreserveHost = preserveHost
+}
+
+func (rp *reverseProxy) GetPreserveHost() bool {
+	return rp.PreserveHost
+}
+
+func (rp *reverseProxy) SetTrustForwardHeaders(trustForwardHeaders bool) {
+	rp.TrustForwardHeaders = trustForwardHeaders
+}
+
+func (rp *reverseProxy) GetTrustForwardHeaders() bool {
+	return rp.TrustForwardHeaders
+}
+
+// clone returns a shallow copy of rp, letting a caller set a per-request
+// ProxyURL/PreserveHost on the copy without racing other requests sharing
+// rp. Interceptor slices are copied by reference, which is safe since they
+// are only appended to during setup, before any request is served.
+func (rp *reverseProxy) clone() *reverseProxy {
+	cloned := *rp
+	return &cloned
+}
+
+func (rp *reverseProxy) OnRequest(cond RequestCond, fn func(*http.Request) (*http.Request, *http.Response)) {
+	rp.requestInterceptors = append(rp.requestInterceptors, requestInterceptor{cond, fn})
+}
+
+func (rp *reverseProxy) OnResponse(cond ResponseCond, fn func(*http.Response) *http.Response) {
+	rp.responseInterceptors = append(rp.responseInterceptors, responseInterceptor{cond, fn})
+}
+
 // serveReverseProxy is the main function in charge of creating the
 // reverse proxy from httputil.NewSingleHostReverseProxy and forwarding
 // the request.
@@ -92,32 +298,73 @@ func (rp *reverseProxy) serveReverseProxy(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	if rp.GetUpgradeAware() && isUpgradeRequest(r) {
+		rp.serveUpgradeAwareProxy(w, r, errorHandler, url)
+		return
+	}
+
 	// Create reverse proxy
 	proxy := httputil.NewSingleHostReverseProxy(url)
 
 	r.URL.Host = url.Host
 	r.URL.Scheme = url.Scheme
 	r.Header.Set("X-Forwarded-Host", r.Header.Get("Host"))
-	r.Host = url.Host
+	if !rp.GetPreserveHost() {
+		r.Host = url.Host
+	}
+
+	var shortCircuit *http.Response
+
+	defaultDirector := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		defaultDirector(req)
+		removeHopByHopHeaders(req.Header)
+		setForwardedHeaders(req, rp.GetTrustForwardHeaders())
+		shortCircuit = rp.runRequestInterceptors(req)
+	}
+
+	proxy.Transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if shortCircuit != nil {
+			return shortCircuit, nil
+		}
+		return http.DefaultTransport.RoundTrip(req)
+	})
+
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		removeHopByHopHeaders(resp.Header)
+		rp.runResponseInterceptors(resp)
+		return nil
+	}
 
 	proxy.ServeHTTP(w, r)
 }
 
-// decodeURLFromBody reads the request body and unmarshals it into a rp.
-// Resets r.Body so that it can be reads from other handlers.
-// Errors when body is not valid JSON syntax.
-func (rp *reverseProxy) decodeURLFromBody(r *http.Request, errorHandler ErrorHandler) error {
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		return err
+// decodeURLFromBody stream-decodes the leading JSON object of the request
+// body into rp, capping the read at maxPayloadBytes (defaultMaxPayloadBytes
+// if zero or negative) so a large or slow-streaming body can't be used to
+// exhaust memory. It errors when Content-Type isn't application/json, when
+// the body exceeds the cap, or when the body isn't valid JSON. Afterwards
+// r.Body is reset to a reader of the full original body - the bytes the
+// decoder consumed, followed by whatever it hadn't yet read - so later
+// handlers and the proxied request still see it intact.
+func (rp *reverseProxy) decodeURLFromBody(w http.ResponseWriter, r *http.Request, maxPayloadBytes int64, errorHandler ErrorHandler) error {
+	if contentType := r.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "application/json") {
+		return fmt.Errorf("decodeURLFromBody: unsupported Content-Type %q, expected application/json", contentType)
 	}
 
-	r.Body = ioutil.NopCloser(bytes.NewBuffer(body))
+	if maxPayloadBytes <= 0 {
+		maxPayloadBytes = defaultMaxPayloadBytes
+	}
+	body := r.Body
+	limited := http.MaxBytesReader(w, body, maxPayloadBytes)
 
-	err = json.Unmarshal(body, rp)
-	if err != nil {
+	var consumed bytes.Buffer
+	decoder := json.NewDecoder(io.TeeReader(limited, &consumed))
+	if err := decoder.Decode(rp); err != nil {
 		return err
 	}
 
+	r.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(consumed.Bytes()), body))
+
 	return nil
 }
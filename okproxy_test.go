@@ -2,7 +2,6 @@ package okproxy
 
 import (
 	"bytes"
-	"errors"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -19,8 +18,11 @@ func (meh *mockErrorHandler) ServerErrorHandler(w http.ResponseWriter, r *http.R
 }
 
 type mockReverseProxy struct {
-	URL   string
-	calls []string
+	URL                 string
+	UpgradeAware        bool
+	PreserveHost        bool
+	TrustForwardHeaders bool
+	calls               []string
 }
 
 func (mrp *mockReverseProxy) SetProxyURL(url string) {
@@ -31,11 +33,43 @@ func (mrp *mockReverseProxy) GetProxyURL() string {
 	return mrp.URL
 }
 
+func (mrp *mockReverseProxy) SetUpgradeAware(upgradeAware bool) {
+	mrp.UpgradeAware = upgradeAware
+}
+
+func (mrp *mockReverseProxy) GetUpgradeAware() bool {
+	return mrp.UpgradeAware
+}
+
+func (mrp *mockReverseProxy) SetPreserveHost(preserveHost bool) {
+	mrp.PreserveHost = preserveHost
+}
+
+func (mrp *mockReverseProxy) GetPreserveHost() bool {
+	return mrp.PreserveHost
+}
+
+func (mrp *mockReverseProxy) SetTrustForwardHeaders(trustForwardHeaders bool) {
+	mrp.TrustForwardHeaders = trustForwardHeaders
+}
+
+func (mrp *mockReverseProxy) GetTrustForwardHeaders() bool {
+	return mrp.TrustForwardHeaders
+}
+
+func (mrp *mockReverseProxy) OnRequest(cond RequestCond, fn func(*http.Request) (*http.Request, *http.Response)) {
+	mrp.calls = append(mrp.calls, "OnRequest")
+}
+
+func (mrp *mockReverseProxy) OnResponse(cond ResponseCond, fn func(*http.Response) *http.Response) {
+	mrp.calls = append(mrp.calls, "OnResponse")
+}
+
 func (mrp *mockReverseProxy) serveReverseProxy(http.ResponseWriter, *http.Request, ErrorHandler) {
 	mrp.calls = append(mrp.calls, "serveReverseProxy")
 }
 
-func (mrp *mockReverseProxy) decodeURLFromBody(r *http.Request, errorHandler ErrorHandler) error {
+func (mrp *mockReverseProxy) decodeURLFromBody(w http.ResponseWriter, r *http.Request, maxPayloadBytes int64, errorHandler ErrorHandler) error {
 	mrp.calls = append(mrp.calls, "decodeURLFromBody")
 	return nil
 }
@@ -56,7 +90,7 @@ func TestPathRequestProxyHandler(t *testing.T) {
 			"Trims path and forward request",
 			httptest.NewRecorder(),
 			httptest.NewRequest("GET", "/forward/api", nil),
-			&OKProxy{&mockReverseProxy{"127.0.0.1:8080", []string{}}},
+			&OKProxy{proxy: &mockReverseProxy{URL: "127.0.0.1:8080", calls: []string{}}},
 			"/forward",
 			&mockErrorHandler{},
 			"/api",
@@ -67,7 +101,7 @@ func TestPathRequestProxyHandler(t *testing.T) {
 			"Errors on empty proxy URL",
 			httptest.NewRecorder(),
 			httptest.NewRequest("GET", "/forward/api", nil),
-			&OKProxy{&mockReverseProxy{}},
+			&OKProxy{proxy: &mockReverseProxy{}},
 			"",
 			&mockErrorHandler{},
 			"/forward/api",
@@ -116,7 +150,7 @@ func TestPayloadRequestProxyHandler(t *testing.T) {
 			"Sets proxy url and forwards request",
 			httptest.NewRecorder(),
 			httptest.NewRequest("GET", "/forward/api", bytes.NewReader([]byte(`{"proxyURL":"127.0.0.1:8080"}`))),
-			&OKProxy{&mockReverseProxy{"127.0.0.1:8080", []string{}}},
+			&OKProxy{proxy: &mockReverseProxy{URL: "127.0.0.1:8080", calls: []string{}}},
 			&mockErrorHandler{},
 			"/forward/api",
 			false,
@@ -126,7 +160,7 @@ func TestPayloadRequestProxyHandler(t *testing.T) {
 			"Errors on decoding",
 			httptest.NewRecorder(),
 			httptest.NewRequest("GET", "/forward/api", bytes.NewReader([]byte(`{"proxyURL":"127.0.0.1:8080"`))),
-			&OKProxy{&mockReverseProxy{}},
+			&OKProxy{proxy: &mockReverseProxy{}},
 			&mockErrorHandler{},
 			"/forward/api",
 			true,
@@ -136,12 +170,26 @@ func TestPayloadRequestProxyHandler(t *testing.T) {
 			"Errors on empty proxy",
 			httptest.NewRecorder(),
 			httptest.NewRequest("GET", "/forward/api", bytes.NewReader([]byte(`{"proxyURL":"127.0.0.1:8080"}`))),
-			&OKProxy{&mockReverseProxy{}},
+			&OKProxy{proxy: &mockReverseProxy{}},
 			&mockErrorHandler{},
 			"/forward/api",
 			true,
 			false,
 		},
+		{
+			"X-Proxy-URL header sets proxy and skips body decoding",
+			httptest.NewRecorder(),
+			func() *http.Request {
+				r := httptest.NewRequest("GET", "/forward/api", nil)
+				r.Header.Set("X-Proxy-URL", "127.0.0.1:9090")
+				return r
+			}(),
+			&OKProxy{proxy: &mockReverseProxy{}},
+			&mockErrorHandler{},
+			"/forward/api",
+			false,
+			true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -200,7 +248,7 @@ func TestServeReverseProxy(t *testing.T) {
 			"Updates URL and request data",
 			httptest.NewRecorder(),
 			createRequest(true),
-			&reverseProxy{"https://127.0.0.1:8080"},
+			&reverseProxy{URL: "https://127.0.0.1:8080"},
 			&mockErrorHandler{},
 			&url{"127.0.0.1:8080", "https"},
 			&requestData{"127.0.0.1:8080", "127.0.0.1:8080"},
@@ -210,7 +258,7 @@ func TestServeReverseProxy(t *testing.T) {
 			"Errors on url parse",
 			httptest.NewRecorder(),
 			createRequest(false),
-			&reverseProxy{"http\ns://6876826^@30"},
+			&reverseProxy{URL: "http\ns://6876826^@30"},
 			&mockErrorHandler{},
 			&url{},
 			&requestData{"", "example.com"},
@@ -239,47 +287,82 @@ func TestServeReverseProxy(t *testing.T) {
 	}
 }
 
+func newJSONRequest(body string) *http.Request {
+	r := httptest.NewRequest("GET", "/", bytes.NewReader([]byte(body)))
+	r.Header.Set("Content-Type", "application/json")
+	return r
+}
+
 func TestDecodeURLFromBody(t *testing.T) {
 	tests := []struct {
-		name          string
-		r             *http.Request
-		url           string
-		errorHandler  *mockErrorHandler
-		expectedProxy *OKProxy
-		expectedBody  []byte
-		expectedError error
+		name            string
+		r               *http.Request
+		maxPayloadBytes int64
+		expectedURL     string
+		expectedBody    []byte
+		expectedErr     string
 	}{
 		{
 			"Unmarshals body",
-			httptest.NewRequest("GET", "/", bytes.NewReader([]byte(`{"proxyURL":"127.0.0.1:8080"}`))),
+			newJSONRequest(`{"proxyURL":"127.0.0.1:8080"}`),
+			0,
 			"127.0.0.1:8080",
-			&mockErrorHandler{},
-			&OKProxy{&reverseProxy{"127.0.0.1:8080"}},
 			[]byte(`{"proxyURL":"127.0.0.1:8080"}`),
-			nil,
+			"",
 		},
 		{
-			"Errors on json unmarshal",
-			httptest.NewRequest("GET", "/", bytes.NewReader([]byte(`{"proxyURL":"127.0.0.1:8080}`))),
+			"Leaves trailing bytes after the JSON object intact",
+			newJSONRequest(`{"proxyURL":"127.0.0.1:8080"}` + "\ntrailing"),
+			0,
 			"127.0.0.1:8080",
-			&mockErrorHandler{},
-			&OKProxy{&reverseProxy{"127.0.0.1:8080"}},
-			[]byte(`{"proxyURL":"127.0.0.1:8080}`),
-			errors.New("unexpected end of JSON input"),
+			[]byte(`{"proxyURL":"127.0.0.1:8080"}` + "\ntrailing"),
+			"",
+		},
+		{
+			"Errors on json decode",
+			newJSONRequest(`{"proxyURL":"127.0.0.1:8080}`),
+			0,
+			"",
+			nil,
+			"unexpected EOF",
+		},
+		{
+			"Errors on wrong content type",
+			httptest.NewRequest("GET", "/", bytes.NewReader([]byte(`{"proxyURL":"127.0.0.1:8080"}`))),
+			0,
+			"",
+			nil,
+			`decodeURLFromBody: unsupported Content-Type "", expected application/json`,
+		},
+		{
+			"Errors when body exceeds maxPayloadBytes",
+			newJSONRequest(`{"proxyURL":"127.0.0.1:8080"}`),
+			5,
+			"",
+			nil,
+			"http: request body too large",
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			p := &OKProxy{&reverseProxy{tt.url}}
-			err := p.proxy.decodeURLFromBody(tt.r, tt.errorHandler)
-
-			if err != nil && err.Error() != tt.expectedError.Error() {
-				t.Errorf("Expected %q got %q", tt.expectedError.Error(), err.Error())
+			rp := &reverseProxy{}
+			w := httptest.NewRecorder()
+			err := rp.decodeURLFromBody(w, tt.r, tt.maxPayloadBytes, &mockErrorHandler{})
+
+			if tt.expectedErr == "" {
+				if err != nil {
+					t.Fatalf("Expected no error got %v", err)
+				}
+			} else {
+				if err == nil || err.Error() != tt.expectedErr {
+					t.Fatalf("Expected error %q got %v", tt.expectedErr, err)
+				}
+				return
 			}
 
-			if p.proxy.GetProxyURL() != tt.expectedProxy.proxy.GetProxyURL() {
-				t.Errorf("Expected %q got %q", "127.0.0.1:8080", p.proxy.GetProxyURL())
+			if rp.GetProxyURL() != tt.expectedURL {
+				t.Errorf("Expected %q got %q", tt.expectedURL, rp.GetProxyURL())
 			}
 
 			body, err := ioutil.ReadAll(tt.r.Body)
@@ -291,7 +374,25 @@ func TestDecodeURLFromBody(t *testing.T) {
 			}
 		})
 	}
+}
+
+func TestPayloadRequestProxyHandlerStreaming(t *testing.T) {
+	var receivedBody []byte
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedBody, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer backend.Close()
 
+	p := New("")
+	w := httptest.NewRecorder()
+	payload := `{"proxyURL":"` + backend.URL + `"}` + "\nmore-data-to-forward"
+	r := newJSONRequest(payload)
+
+	p.PayloadRequestProxyHandler(&mockErrorHandler{}).ServeHTTP(w, r)
+
+	if string(receivedBody) != payload {
+		t.Errorf("Expected backend to receive full streamed body %q got %q", payload, string(receivedBody))
+	}
 }
 
 func stringInSlice(s string, sl []string) bool {
@@ -0,0 +1,235 @@
+package okproxy
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// TunnelProxyHandler handles HTTP CONNECT requests, turning OKProxy into a
+// forward proxy for arbitrary TCP traffic (typically HTTPS). The client
+// connection is hijacked and, unless MITM is enabled, blindly spliced to the
+// requested host:port. errorHandler is used for non-CONNECT requests and
+// hijack failures; a failed dial to host:port is answered with a raw
+// 502 Bad Gateway on the hijacked connection instead. Once the tunnel is
+// established, errors are not recoverable and the connection is simply
+// closed.
+func (p *OKProxy) TunnelProxyHandler(errorHandler ErrorHandler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			errorHandler.ServerErrorHandler(w, r, errors.New("TunnelProxyHandler: only CONNECT requests are supported"))
+			return
+		}
+
+		hijacker, ok := w.(http.Hijacker)
+		if !ok {
+			errorHandler.ServerErrorHandler(w, r, errors.New("TunnelProxyHandler: ResponseWriter does not support hijacking"))
+			return
+		}
+
+		clientConn, bufrw, err := hijacker.Hijack()
+		if err != nil {
+			errorHandler.ServerErrorHandler(w, r, err)
+			return
+		}
+
+		var conn net.Conn = clientConn
+		if bufrw != nil {
+			conn = &bufferedClientConn{Conn: clientConn, r: bufrw.Reader}
+		}
+
+		if p.MITM {
+			p.serveMITMTunnel(conn, r, errorHandler)
+			return
+		}
+
+		p.serveBlindTunnel(conn, r)
+	})
+}
+
+// serveBlindTunnel dials r.Host, replies 200 OK and splices the raw
+// connections together without inspecting the tunneled bytes.
+func (p *OKProxy) serveBlindTunnel(clientConn net.Conn, r *http.Request) {
+	defer clientConn.Close()
+
+	backendConn, err := net.Dial("tcp", r.Host)
+	if err != nil {
+		clientConn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+		return
+	}
+	defer backendConn.Close()
+
+	if _, err := clientConn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n")); err != nil {
+		return
+	}
+
+	spliceConns(clientConn, backendConn, backendConn)
+}
+
+// serveMITMTunnel terminates TLS on the client connection using a leaf
+// certificate minted for the requested SNI, then runs the decrypted traffic
+// back through serveReverseProxy so the request/response interceptor
+// pipeline applies to HTTPS traffic the same way it does to plain HTTP.
+func (p *OKProxy) serveMITMTunnel(clientConn net.Conn, r *http.Request, errorHandler ErrorHandler) {
+	defer clientConn.Close()
+
+	if _, err := clientConn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n")); err != nil {
+		return
+	}
+
+	tlsConn := tls.Server(clientConn, &tls.Config{
+		GetCertificate: p.mitmCertificateFor,
+	})
+	if err := tlsConn.Handshake(); err != nil {
+		return
+	}
+	defer tlsConn.Close()
+
+	host := r.URL.Hostname()
+	if host == "" {
+		host = r.Host
+	}
+
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			req.URL.Scheme = "https"
+			req.URL.Host = host
+
+			rp, ok := p.proxy.(*reverseProxy)
+			if !ok {
+				errorHandler.ServerErrorHandler(w, req, errors.New("serveMITMTunnel: proxy does not support MITM"))
+				return
+			}
+
+			perTunnel := rp.clone()
+			perTunnel.SetProxyURL("https://" + host)
+			perTunnel.serveReverseProxy(w, req, errorHandler)
+		}),
+	}
+	server.Serve(newSingleConnListener(tlsConn))
+}
+
+// mitmCertificateFor signs a leaf certificate for the SNI requested during
+// the client TLS handshake using OKProxy's configured CACert/CAKey.
+func (p *OKProxy) mitmCertificateFor(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if p.CACert == nil || p.CAKey == nil {
+		return nil, errors.New("MITM: CACert and CAKey must be set")
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: hello.ServerName},
+		DNSNames:     []string{hello.ServerName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	leafDER, err := x509.CreateCertificate(rand.Reader, template, p.CACert, &leafKey.PublicKey, p.CAKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{leafDER, p.CACert.Raw},
+		PrivateKey:  leafKey,
+	}, nil
+}
+
+// bufferedClientConn wraps a hijacked client connection so reads drain
+// whatever http.Hijacker already buffered - e.g. a client pipelining its TLS
+// ClientHello right after the CONNECT request line - before falling through
+// to fresh reads off the raw connection.
+type bufferedClientConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedClientConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// CloseWrite lets bufferedClientConn still satisfy halfCloser when the
+// connection it wraps does, since embedding the net.Conn interface alone
+// wouldn't promote the underlying concrete type's CloseWrite method.
+func (c *bufferedClientConn) CloseWrite() error {
+	hc, ok := c.Conn.(halfCloser)
+	if !ok {
+		return errors.New("bufferedClientConn: underlying connection does not support CloseWrite")
+	}
+	return hc.CloseWrite()
+}
+
+// singleConnListener adapts an already-established net.Conn to the
+// net.Listener interface expected by http.Server.Serve, letting the decrypted
+// MITM connection be served with the stdlib's own request parsing instead of
+// reimplementing it. Accept hands out conn exactly once, wrapped so that
+// http.Server closing it (as it does once the client disconnects) closes the
+// listener too: the next Accept call then errors out instead of blocking
+// forever, letting Serve return.
+type singleConnListener struct {
+	conn     net.Conn
+	once     sync.Once
+	consumed bool
+	closed   chan struct{}
+}
+
+func newSingleConnListener(conn net.Conn) *singleConnListener {
+	return &singleConnListener{conn: conn, closed: make(chan struct{})}
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	if !l.consumed {
+		l.consumed = true
+		return &closeNotifyingConn{Conn: l.conn, notify: l.Close}, nil
+	}
+	<-l.closed
+	return nil, net.ErrClosed
+}
+
+func (l *singleConnListener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+		l.conn.Close()
+	})
+	return nil
+}
+
+func (l *singleConnListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// closeNotifyingConn wraps a net.Conn and calls notify once Close is called,
+// so singleConnListener learns that http.Server is done with the connection
+// and can unblock its pending Accept.
+type closeNotifyingConn struct {
+	net.Conn
+	notify func() error
+}
+
+func (c *closeNotifyingConn) Close() error {
+	err := c.Conn.Close()
+	c.notify()
+	return err
+}
@@ -0,0 +1,258 @@
+package okproxy
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTestCA mints a minimal self-signed CA usable with OKProxy.CACert/CAKey.
+func newTestCA(t *testing.T) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "okproxy test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return caCert, caKey
+}
+
+func TestTunnelProxyHandlerBlind(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 1024)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		conn.Write(buf[:n])
+	}()
+
+	p := New("")
+	frontend := httptest.NewServer(p.TunnelProxyHandler(&mockErrorHandler{}))
+	defer frontend.Close()
+
+	conn, err := net.Dial("tcp", frontend.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", backend.Addr().String(), backend.Addr().String())
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status %d got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	payload := []byte("hello")
+	if _, err := conn.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+
+	echoed := make([]byte, len(payload))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := reader.Read(echoed); err != nil {
+		t.Fatal(err)
+	}
+	if string(echoed) != string(payload) {
+		t.Errorf("Expected echoed %q got %q", payload, echoed)
+	}
+}
+
+func TestTunnelProxyHandlerMITM(t *testing.T) {
+	caCert, caKey := newTestCA(t)
+
+	p := New("")
+	p.MITM = true
+	p.CACert = caCert
+	p.CAKey = caKey
+
+	frontend := httptest.NewServer(p.TunnelProxyHandler(&mockErrorHandler{}))
+	defer frontend.Close()
+
+	conn, err := net.Dial("tcp", frontend.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status %d got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: "example.com", RootCAs: pool})
+	defer tlsConn.Close()
+
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("MITM handshake failed: %v", err)
+	}
+
+	state := tlsConn.ConnectionState()
+	if len(state.PeerCertificates) == 0 || state.PeerCertificates[0].Subject.CommonName != "example.com" {
+		t.Errorf("Expected leaf certificate for example.com, got %+v", state.PeerCertificates)
+	}
+}
+
+// TestServeMITMTunnelReturnsAfterClientDisconnects guards against the
+// singleConnListener never unblocking Serve once the client goes away, which
+// used to leak the serveMITMTunnel goroutine (and its hijacked conns) forever.
+func TestServeMITMTunnelReturnsAfterClientDisconnects(t *testing.T) {
+	caCert, caKey := newTestCA(t)
+
+	p := New("")
+	p.MITM = true
+	p.CACert = caCert
+	p.CAKey = caKey
+
+	serverConn, clientConn := net.Pipe()
+
+	req := httptest.NewRequest(http.MethodConnect, "/", nil)
+	req.Host = "example.com:443"
+	req.URL.Host = "example.com:443"
+
+	done := make(chan struct{})
+	go func() {
+		p.serveMITMTunnel(serverConn, req, &mockErrorHandler{})
+		close(done)
+	}()
+
+	reader := bufio.NewReader(clientConn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status %d got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+	tlsConn := tls.Client(clientConn, &tls.Config{ServerName: "example.com", RootCAs: pool})
+
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("MITM handshake failed: %v", err)
+	}
+	tlsConn.Close()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("serveMITMTunnel did not return after the client disconnected; singleConnListener leaked")
+	}
+}
+
+// TestTunnelProxyHandlerBlindForwardsPipelinedBytes guards against bytes the
+// client pipelines right after the CONNECT request line (the way a client
+// eagerly sending its TLS ClientHello would) getting stuck in the buffered
+// ReadWriter that http.Hijacker hands back and silently dropped.
+func TestTunnelProxyHandlerBlindForwardsPipelinedBytes(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 1024)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		received <- string(buf[:n])
+	}()
+
+	p := New("")
+	frontend := httptest.NewServer(p.TunnelProxyHandler(&mockErrorHandler{}))
+	defer frontend.Close()
+
+	conn, err := net.Dial("tcp", frontend.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Write the CONNECT request and a trailing payload in a single call so
+	// they're likely to land in the same read the hijacked http.Server does,
+	// landing the payload in the hijacked bufio.ReadWriter's buffer.
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\npipelined", backend.Addr().String(), backend.Addr().String())
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status %d got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	select {
+	case got := <-received:
+		if got != "pipelined" {
+			t.Errorf("Expected backend to receive %q got %q", "pipelined", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("backend never received the pipelined bytes; they were dropped")
+	}
+}
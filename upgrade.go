@@ -0,0 +1,130 @@
+package okproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// isUpgradeRequest reports whether r is asking for a protocol upgrade (e.g.
+// WebSocket, SPDY or HTTP/2 h2c) via the Connection/Upgrade headers, the
+// same way a compliant upgrade-aware proxy decides whether to hijack.
+func isUpgradeRequest(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, token := range strings.Split(r.Header.Get("Connection"), ",") {
+		if strings.EqualFold(strings.TrimSpace(token), "Upgrade") {
+			return true
+		}
+	}
+	return false
+}
+
+// serveUpgradeAwareProxy handles protocol upgrade requests that
+// httputil.ReverseProxy cannot: it dials target directly, forwards the
+// original request, then hijacks the client connection and splices the two
+// raw connections together so the upgraded protocol flows unmodified in
+// both directions.
+func (rp *reverseProxy) serveUpgradeAwareProxy(w http.ResponseWriter, r *http.Request, errorHandler ErrorHandler, target *url.URL) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		errorHandler.ServerErrorHandler(w, r, errors.New("serveUpgradeAwareProxy: ResponseWriter does not support hijacking"))
+		return
+	}
+
+	backendConn, err := dialUpstream(target)
+	if err != nil {
+		errorHandler.ServerErrorHandler(w, r, err)
+		return
+	}
+
+	r.URL.Host = target.Host
+	r.URL.Scheme = target.Scheme
+	r.Header.Set("X-Forwarded-Host", r.Header.Get("Host"))
+	if !rp.GetPreserveHost() {
+		r.Host = target.Host
+	}
+
+	if err := r.Write(backendConn); err != nil {
+		backendConn.Close()
+		errorHandler.ServerErrorHandler(w, r, err)
+		return
+	}
+
+	backendReader := bufio.NewReader(backendConn)
+	resp, err := http.ReadResponse(backendReader, r)
+	if err != nil {
+		backendConn.Close()
+		errorHandler.ServerErrorHandler(w, r, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	clientConn, _, err := hijacker.Hijack()
+	if err != nil {
+		backendConn.Close()
+		errorHandler.ServerErrorHandler(w, r, err)
+		return
+	}
+	defer clientConn.Close()
+	defer backendConn.Close()
+
+	if err := resp.Write(clientConn); err != nil {
+		return
+	}
+
+	spliceConns(clientConn, backendConn, backendReader)
+}
+
+// dialUpstream dials target, negotiating TLS when the scheme calls for it.
+func dialUpstream(target *url.URL) (net.Conn, error) {
+	switch target.Scheme {
+	case "https", "wss":
+		return tls.Dial("tcp", target.Host, &tls.Config{})
+	default:
+		return net.Dial("tcp", target.Host)
+	}
+}
+
+// halfCloser is implemented by connections (e.g. *net.TCPConn) that support
+// closing only the write side, letting the peer observe EOF without tearing
+// down the whole connection.
+type halfCloser interface {
+	CloseWrite() error
+}
+
+// spliceConns copies bytes bidirectionally between client and backend until
+// both directions have reached EOF or errored, the same shape the Kubernetes
+// apimachinery upgrade-aware proxy and goproxy's CONNECT tunnel use.
+// backendReader reads the backend side instead of backendConn directly,
+// since it may already hold bytes buffered past the 101 response headers
+// that backendConn.Read would never return again.
+func spliceConns(clientConn, backendConn net.Conn, backendReader io.Reader) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		io.Copy(clientConn, backendReader)
+		if hc, ok := clientConn.(halfCloser); ok {
+			hc.CloseWrite()
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		io.Copy(backendConn, clientConn)
+		if hc, ok := backendConn.(halfCloser); ok {
+			hc.CloseWrite()
+		}
+	}()
+
+	wg.Wait()
+}
@@ -0,0 +1,214 @@
+package okproxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestIsUpgradeRequest(t *testing.T) {
+	tests := []struct {
+		name     string
+		upgrade  string
+		conn     string
+		expected bool
+	}{
+		{"Upgrade with matching Connection header", "websocket", "Upgrade", true},
+		{"Upgrade with multi-value Connection header", "websocket", "keep-alive, Upgrade", true},
+		{"No Upgrade header", "", "Upgrade", false},
+		{"Upgrade header without Connection: Upgrade", "websocket", "keep-alive", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.upgrade != "" {
+				r.Header.Set("Upgrade", tt.upgrade)
+			}
+			if tt.conn != "" {
+				r.Header.Set("Connection", tt.conn)
+			}
+
+			if actual := isUpgradeRequest(r); actual != tt.expected {
+				t.Errorf("Expected %t got %t", tt.expected, actual)
+			}
+		})
+	}
+}
+
+// newEchoUpgradeBackend starts a raw listener that completes a 101 Switching
+// Protocols handshake for any request carrying an Upgrade header and then
+// echoes whatever bytes it receives back to the caller.
+func newEchoUpgradeBackend(t *testing.T) net.Listener {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+		if _, err := http.ReadRequest(reader); err != nil {
+			return
+		}
+
+		conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"))
+
+		buf := make([]byte, 1024)
+		n, err := reader.Read(buf)
+		if err != nil {
+			return
+		}
+		conn.Write(buf[:n])
+	}()
+
+	return ln
+}
+
+// newPushingUpgradeBackend starts a raw listener that completes a 101
+// handshake and writes the 101 response and a payload in a single conn.Write
+// call, so any bytes past the response headers arrive already buffered in
+// whatever reads the handshake off the wire.
+func newPushingUpgradeBackend(t *testing.T, pushed string) net.Listener {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+		if _, err := http.ReadRequest(reader); err != nil {
+			return
+		}
+
+		conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n" + pushed))
+	}()
+
+	return ln
+}
+
+func TestServeUpgradeAwareProxyForwardsBytesPushedWithHandshake(t *testing.T) {
+	backend := newPushingUpgradeBackend(t, "PUSHED")
+	defer backend.Close()
+
+	rp := &reverseProxy{URL: "http://" + backend.Addr().String(), UpgradeAware: true}
+	target, err := url.Parse(rp.GetProxyURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frontend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rp.serveUpgradeAwareProxy(w, r, &mockErrorHandler{}, target)
+	}))
+	defer frontend.Close()
+
+	clientConn, err := net.DialTimeout("tcp", frontend.Listener.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+
+	req, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	if err := req.Write(clientConn); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := bufio.NewReader(clientConn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	pushed := make([]byte, len("PUSHED"))
+	clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(reader, pushed); err != nil {
+		t.Fatalf("Expected pushed bytes to be forwarded, got error %v", err)
+	}
+	if string(pushed) != "PUSHED" {
+		t.Errorf("Expected %q got %q", "PUSHED", pushed)
+	}
+}
+
+func TestServeUpgradeAwareProxy(t *testing.T) {
+	backend := newEchoUpgradeBackend(t)
+	defer backend.Close()
+
+	rp := &reverseProxy{URL: "http://" + backend.Addr().String(), UpgradeAware: true}
+	target, err := url.Parse(rp.GetProxyURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frontend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rp.serveUpgradeAwareProxy(w, r, &mockErrorHandler{}, target)
+	}))
+	defer frontend.Close()
+
+	clientConn, err := net.DialTimeout("tcp", frontend.Listener.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+
+	req, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	if err := req.Write(clientConn); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := bufio.NewReader(clientConn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Errorf("Expected status %d got %d", http.StatusSwitchingProtocols, resp.StatusCode)
+	}
+
+	payload := []byte("hello")
+	if _, err := clientConn.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+
+	echoed := make([]byte, len(payload))
+	clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := reader.Read(echoed); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(echoed) != string(payload) {
+		t.Errorf("Expected echoed %q got %q", payload, echoed)
+	}
+}
@@ -0,0 +1,228 @@
+package okproxy
+
+import (
+	"errors"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LoadBalancer selects which backend in a Route's pool serves the next
+// request.
+type LoadBalancer int
+
+const (
+	// RoundRobin cycles through healthy backends in order.
+	RoundRobin LoadBalancer = iota
+	// Random picks a healthy backend uniformly at random.
+	Random
+	// LeastConn picks the healthy backend with the fewest in-flight requests.
+	LeastConn
+)
+
+// UpstreamConfig configures dynamic upstream selection for RouteProxyHandler.
+// Routes are matched in order; the first match wins.
+type UpstreamConfig struct {
+	Routes []*Route
+}
+
+// matchRoute returns the first route in config that matches r, or nil.
+func (config *UpstreamConfig) matchRoute(r *http.Request) *Route {
+	for _, route := range config.Routes {
+		if route.matches(r) {
+			return route
+		}
+	}
+	return nil
+}
+
+// Route maps incoming requests to one or more backend URLs.
+//
+// A route matches r either through FromRegex, tested against r.Host, or
+// unconditionally when FromRegex is nil, making a FromRegex-less route a
+// catch-all default.
+//
+// When FromRegex matches, its named capture groups are substituted into
+// ToTemplate to compute the backend, e.g.:
+//
+//	FromRegex:  regexp.MustCompile(`^(?P<svc>[^.]+)\.api\.example\.com$`)
+//	ToTemplate: "http://{svc}.internal:8080"
+//
+// routes "foo.api.example.com" to "http://foo.internal:8080". Routes without
+// FromRegex instead pick a backend from To plus Backends, load balanced via
+// Strategy and health-checked in the background when HealthCheckPath is set.
+type Route struct {
+	To         string
+	FromRegex  *regexp.Regexp
+	ToTemplate string
+
+	Backends []string
+	Strategy LoadBalancer
+
+	// PreserveHost, when true, skips the r.Host = url.Host rewrite that
+	// serveReverseProxy performs by default.
+	PreserveHost bool
+
+	// HealthCheckPath, when non-empty, enables periodic health checking of
+	// To/Backends at HealthCheckInterval (default 10s); unhealthy backends
+	// are removed from rotation until a check against them succeeds again.
+	// Only applies to routes without FromRegex.
+	HealthCheckPath     string
+	HealthCheckInterval time.Duration
+
+	pool *backendPool
+}
+
+func (route *Route) matches(r *http.Request) bool {
+	if route.FromRegex == nil {
+		return true
+	}
+	return route.FromRegex.MatchString(r.Host)
+}
+
+// resolveTarget returns the backend URL r should be forwarded to.
+func (route *Route) resolveTarget(r *http.Request) (string, error) {
+	if route.FromRegex != nil {
+		return route.rewriteTarget(r)
+	}
+
+	if route.pool == nil {
+		if route.To == "" {
+			return "", errors.New("resolveTarget: route has no To URL or backend pool configured")
+		}
+		return route.To, nil
+	}
+
+	return route.pool.pick(route.Strategy)
+}
+
+// rewriteTarget substitutes FromRegex's named capture groups from r.Host
+// into ToTemplate, e.g. "{svc}" becomes the "svc" group's match.
+func (route *Route) rewriteTarget(r *http.Request) (string, error) {
+	match := route.FromRegex.FindStringSubmatch(r.Host)
+	if match == nil {
+		return "", errors.New("rewriteTarget: FromRegex did not match host " + r.Host)
+	}
+
+	target := route.ToTemplate
+	for i, name := range route.FromRegex.SubexpNames() {
+		if name == "" {
+			continue
+		}
+		target = strings.ReplaceAll(target, "{"+name+"}", match[i])
+	}
+
+	return target, nil
+}
+
+// backendPool tracks which of a route's backends are currently healthy and
+// picks the next one to use according to a LoadBalancer strategy.
+type backendPool struct {
+	mu       sync.Mutex
+	backends []string
+	healthy  map[string]bool
+	inFlight map[string]int64
+	next     uint64
+}
+
+func newBackendPool(backends []string) *backendPool {
+	healthy := make(map[string]bool, len(backends))
+	inFlight := make(map[string]int64, len(backends))
+	for _, backend := range backends {
+		healthy[backend] = true
+		inFlight[backend] = 0
+	}
+	return &backendPool{backends: backends, healthy: healthy, inFlight: inFlight}
+}
+
+func (pool *backendPool) setHealthy(backend string, ok bool) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	pool.healthy[backend] = ok
+}
+
+func (pool *backendPool) healthyBackends() []string {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	healthy := make([]string, 0, len(pool.backends))
+	for _, backend := range pool.backends {
+		if pool.healthy[backend] {
+			healthy = append(healthy, backend)
+		}
+	}
+	return healthy
+}
+
+// pick selects the next backend according to strategy, or an error if none
+// are currently healthy.
+func (pool *backendPool) pick(strategy LoadBalancer) (string, error) {
+	candidates := pool.healthyBackends()
+	if len(candidates) == 0 {
+		return "", errors.New("backendPool: no healthy backends available")
+	}
+
+	switch strategy {
+	case Random:
+		return candidates[rand.Intn(len(candidates))], nil
+	case LeastConn:
+		pool.mu.Lock()
+		defer pool.mu.Unlock()
+		best := candidates[0]
+		for _, backend := range candidates[1:] {
+			if pool.inFlight[backend] < pool.inFlight[best] {
+				best = backend
+			}
+		}
+		return best, nil
+	default: // RoundRobin
+		idx := atomic.AddUint64(&pool.next, 1)
+		return candidates[idx%uint64(len(candidates))], nil
+	}
+}
+
+func (pool *backendPool) begin(backend string) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	pool.inFlight[backend]++
+}
+
+func (pool *backendPool) end(backend string) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	pool.inFlight[backend]--
+}
+
+// startHealthChecks polls each backend at interval via path, marking it
+// healthy or unhealthy based on the response status, until stop is closed.
+func (pool *backendPool) startHealthChecks(path string, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				pool.checkOnce(path)
+			}
+		}
+	}()
+}
+
+func (pool *backendPool) checkOnce(path string) {
+	for _, backend := range pool.backends {
+		resp, err := http.Get(backend + path)
+		if err != nil {
+			pool.setHealthy(backend, false)
+			continue
+		}
+		pool.setHealthy(backend, resp.StatusCode < 400)
+		resp.Body.Close()
+	}
+}
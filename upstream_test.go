@@ -0,0 +1,245 @@
+package okproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newBackend(t *testing.T, body string) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+}
+
+func TestRouteProxyHandlerFromRegex(t *testing.T) {
+	backend := newBackend(t, "routed")
+	defer backend.Close()
+
+	config := &UpstreamConfig{
+		Routes: []*Route{
+			{
+				FromRegex:  regexp.MustCompile(`^(?P<svc>[^.]+)\.api\.example\.com$`),
+				ToTemplate: backend.URL,
+			},
+		},
+	}
+	p := NewWithConfig(config)
+	defer p.Close()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Host = "foo.api.example.com"
+
+	p.RouteProxyHandler(&mockErrorHandler{}).ServeHTTP(w, r)
+
+	if w.Body.String() != "routed" {
+		t.Errorf("Expected body %q got %q", "routed", w.Body.String())
+	}
+}
+
+func TestRouteProxyHandlerNoMatch(t *testing.T) {
+	config := &UpstreamConfig{
+		Routes: []*Route{
+			{FromRegex: regexp.MustCompile(`^only\.example\.com$`), ToTemplate: "http://127.0.0.1:1"},
+		},
+	}
+	p := NewWithConfig(config)
+	defer p.Close()
+
+	errorHandler := &mockErrorHandler{}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Host = "other.example.com"
+
+	p.RouteProxyHandler(errorHandler).ServeHTTP(w, r)
+
+	if !errorHandler.called {
+		t.Error("Expected errorHandler to be called when no route matches")
+	}
+}
+
+func TestRouteProxyHandlerRoundRobin(t *testing.T) {
+	var seen []string
+	backendA := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("a"))
+	}))
+	defer backendA.Close()
+	backendB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("b"))
+	}))
+	defer backendB.Close()
+
+	config := &UpstreamConfig{
+		Routes: []*Route{
+			{Backends: []string{backendA.URL, backendB.URL}, Strategy: RoundRobin},
+		},
+	}
+	p := NewWithConfig(config)
+	defer p.Close()
+
+	for i := 0; i < 4; i++ {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		p.RouteProxyHandler(&mockErrorHandler{}).ServeHTTP(w, r)
+		seen = append(seen, w.Body.String())
+	}
+
+	if seen[0] == seen[1] && seen[1] == seen[2] && seen[2] == seen[3] {
+		t.Errorf("Expected round robin to alternate backends, got %v", seen)
+	}
+}
+
+func TestRouteProxyHandlerConcurrentRequestsDontCrossTalk(t *testing.T) {
+	backendA := newBackend(t, "a")
+	defer backendA.Close()
+	backendB := newBackend(t, "b")
+	defer backendB.Close()
+
+	config := &UpstreamConfig{
+		Routes: []*Route{
+			{FromRegex: regexp.MustCompile(`^a\.example\.com$`), ToTemplate: backendA.URL},
+			{FromRegex: regexp.MustCompile(`^b\.example\.com$`), ToTemplate: backendB.URL},
+		},
+	}
+	p := NewWithConfig(config)
+	defer p.Close()
+
+	handler := p.RouteProxyHandler(&mockErrorHandler{})
+
+	var wg sync.WaitGroup
+	errs := make(chan string, 100)
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Host = "a.example.com"
+			handler.ServeHTTP(w, r)
+			if w.Body.String() != "a" {
+				errs <- "expected a got " + w.Body.String()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Host = "b.example.com"
+			handler.ServeHTTP(w, r)
+			if w.Body.String() != "b" {
+				errs <- "expected b got " + w.Body.String()
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for msg := range errs {
+		t.Error(msg)
+	}
+}
+
+func TestRouteProxyHandlerPreserveHost(t *testing.T) {
+	var receivedHost string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedHost = r.Host
+	}))
+	defer backend.Close()
+
+	config := &UpstreamConfig{
+		Routes: []*Route{
+			{To: backend.URL, PreserveHost: true},
+		},
+	}
+	p := NewWithConfig(config)
+	defer p.Close()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Host = "original-host.example.com"
+
+	p.RouteProxyHandler(&mockErrorHandler{}).ServeHTTP(w, r)
+
+	if receivedHost != "original-host.example.com" {
+		t.Errorf("Expected preserved host %q got %q", "original-host.example.com", receivedHost)
+	}
+}
+
+func TestBackendPoolHealthChecks(t *testing.T) {
+	healthy := newBackend(t, "ok")
+	defer healthy.Close()
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	pool := newBackendPool([]string{healthy.URL, failing.URL})
+	pool.checkOnce("/")
+
+	candidates := pool.healthyBackends()
+	if len(candidates) != 1 || candidates[0] != healthy.URL {
+		t.Errorf("Expected only %q to be healthy, got %v", healthy.URL, candidates)
+	}
+}
+
+func TestBackendPoolLeastConn(t *testing.T) {
+	pool := newBackendPool([]string{"a", "b"})
+	pool.begin("a")
+	pool.begin("a")
+	pool.begin("b")
+
+	picked, err := pool.pick(LeastConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if picked != "b" {
+		t.Errorf("Expected least-conn to pick %q got %q", "b", picked)
+	}
+}
+
+func TestRouteRewriteTarget(t *testing.T) {
+	route := &Route{
+		FromRegex:  regexp.MustCompile(`^(?P<svc>[^.]+)\.api\.example\.com$`),
+		ToTemplate: "http://{svc}.internal:8080",
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Host = "orders.api.example.com"
+
+	target, err := route.resolveTarget(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "http://orders.internal:8080"; target != expected {
+		t.Errorf("Expected %q got %q", expected, target)
+	}
+}
+
+func TestRouteProxyHandlerServesAfterClose(t *testing.T) {
+	backend := newBackend(t, "ok")
+	defer backend.Close()
+
+	config := &UpstreamConfig{
+		Routes: []*Route{
+			{To: backend.URL, HealthCheckPath: "/", HealthCheckInterval: 5 * time.Millisecond},
+		},
+	}
+	p := NewWithConfig(config)
+	p.Close()
+
+	// Closing twice would panic on a double close; RouteProxyHandler should
+	// still work after Close since it doesn't depend on the health-check loop.
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	p.RouteProxyHandler(&mockErrorHandler{}).ServeHTTP(w, r)
+
+	if w.Body.String() != "ok" {
+		t.Errorf("Expected body %q got %q", "ok", w.Body.String())
+	}
+}